@@ -0,0 +1,177 @@
+package discovery
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	consulapi "github.com/hashicorp/consul/api"
+)
+
+// maasServiceName the name MAAS API instances are expected to register under
+// in Consul's service catalog
+const maasServiceName = "maas"
+
+// filterKeyPrefix the Consul KV prefix filter values are read from, e.g.
+// "maas-flow/filters/hosts/include"
+const filterKeyPrefix = "maas-flow/filters/"
+
+// blockingQueryTimeout how long a single Consul blocking query is allowed to
+// hang waiting for a change before it is retried
+const blockingQueryTimeout = 5 * time.Minute
+
+// retryInterval how long to wait before retrying a failed Consul query. While
+// retrying, the last known good endpoint/filters continue to be served.
+const retryInterval = 10 * time.Second
+
+// ConsulDiscoverer a Discoverer that locates the MAAS endpoint from Consul's
+// service catalog and the host/zone filters from Consul's KV store,
+// refreshing both via blocking queries so changes apply without a restart.
+//
+// If Consul becomes unreachable, ConsulDiscoverer keeps serving the last
+// known good endpoint and filters rather than failing callers or falling
+// back to empty filters.
+type ConsulDiscoverer struct {
+	client *consulapi.Client
+
+	mu       sync.RWMutex
+	endpoint string
+	filters  Filters
+
+	// lastEndpointIndex and lastFiltersIndex are only ever touched by their
+	// respective watch goroutine, so they need no locking of their own
+	lastEndpointIndex uint64
+	lastFiltersIndex  uint64
+}
+
+// NewConsulDiscoverer connects to Consul using cfg, resolves the initial
+// endpoint and filters, and starts background watches to keep both current
+func NewConsulDiscoverer(cfg *consulapi.Config) (*ConsulDiscoverer, error) {
+	client, err := consulapi.NewClient(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("creating consul client: %s", err)
+	}
+
+	d := &ConsulDiscoverer{client: client}
+
+	if err := d.refreshEndpoint(0); err != nil {
+		return nil, fmt.Errorf("resolving initial MAAS endpoint from consul: %s", err)
+	}
+	if err := d.refreshFilters(0); err != nil {
+		return nil, fmt.Errorf("resolving initial filters from consul: %s", err)
+	}
+
+	go d.watchEndpoint()
+	go d.watchFilters()
+
+	return d, nil
+}
+
+// Endpoint returns the most recently discovered MAAS API base URL
+func (d *ConsulDiscoverer) Endpoint() (string, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if d.endpoint == "" {
+		return "", fmt.Errorf("no healthy '%s' service found in consul catalog", maasServiceName)
+	}
+	return d.endpoint, nil
+}
+
+// Filters returns the most recently discovered host/zone filters
+func (d *ConsulDiscoverer) Filters() (Filters, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.filters, nil
+}
+
+// refreshEndpoint looks up a healthy instance of maasServiceName and records
+// its address, blocking for up to blockingQueryTimeout if waitIndex is set
+func (d *ConsulDiscoverer) refreshEndpoint(waitIndex uint64) error {
+	services, meta, err := d.client.Health().Service(maasServiceName, "", true, &consulapi.QueryOptions{
+		WaitIndex: waitIndex,
+		WaitTime:  blockingQueryTimeout,
+	})
+	if err != nil {
+		return err
+	}
+	if len(services) == 0 {
+		return fmt.Errorf("no healthy '%s' service instances registered", maasServiceName)
+	}
+
+	entry := services[0]
+	endpoint := fmt.Sprintf("http://%s:%d/MAAS", entry.Service.Address, entry.Service.Port)
+
+	d.mu.Lock()
+	d.endpoint = endpoint
+	d.mu.Unlock()
+
+	d.lastEndpointIndex = meta.LastIndex
+	return nil
+}
+
+// watchEndpoint blocks on Consul's service health endpoint, updating the
+// discovered MAAS endpoint whenever it changes, and retrying with the last
+// known good value retained if Consul is unreachable
+func (d *ConsulDiscoverer) watchEndpoint() {
+	for {
+		if err := d.refreshEndpoint(d.lastEndpointIndex); err != nil {
+			log.Printf("[warn] consul service discovery for '%s' failed, keeping last known endpoint: %s",
+				maasServiceName, err)
+			time.Sleep(retryInterval)
+		}
+	}
+}
+
+// refreshFilters reads the filter KV keys and records them, blocking for up
+// to blockingQueryTimeout if waitIndex is set
+func (d *ConsulDiscoverer) refreshFilters(waitIndex uint64) error {
+	pairs, meta, err := d.client.KV().List(filterKeyPrefix, &consulapi.QueryOptions{
+		WaitIndex: waitIndex,
+		WaitTime:  blockingQueryTimeout,
+	})
+	if err != nil {
+		return err
+	}
+
+	filters := Filters{}
+	for _, pair := range pairs {
+		var values []string
+		if len(pair.Value) > 0 {
+			if err := json.Unmarshal(pair.Value, &values); err != nil {
+				return fmt.Errorf("decoding consul key '%s': %s", pair.Key, err)
+			}
+		}
+
+		switch pair.Key {
+		case filterKeyPrefix + "hosts/include":
+			filters.Hosts.Include = values
+		case filterKeyPrefix + "hosts/exclude":
+			filters.Hosts.Exclude = values
+		case filterKeyPrefix + "zones/include":
+			filters.Zones.Include = values
+		case filterKeyPrefix + "zones/exclude":
+			filters.Zones.Exclude = values
+		}
+	}
+
+	d.mu.Lock()
+	d.filters = filters
+	d.mu.Unlock()
+
+	d.lastFiltersIndex = meta.LastIndex
+	return nil
+}
+
+// watchFilters blocks on Consul's KV store, updating the discovered filters
+// whenever a key under filterKeyPrefix changes, and retrying with the last
+// known good values retained if Consul is unreachable
+func (d *ConsulDiscoverer) watchFilters() {
+	for {
+		if err := d.refreshFilters(d.lastFiltersIndex); err != nil {
+			log.Printf("[warn] consul filter watch failed, keeping last known filters: %s", err)
+			time.Sleep(retryInterval)
+		}
+	}
+}
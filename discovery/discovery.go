@@ -0,0 +1,54 @@
+// Package discovery locates the MAAS API endpoint and the per-zone host
+// include/exclude filters that drive ProcessAll, so a deployment can be
+// configured from Consul's catalog and KV store instead of static CLI/YAML
+// config.
+package discovery
+
+// ZoneHostFilter include/exclude pattern lists for one filter dimension
+// (hosts or zones)
+type ZoneHostFilter struct {
+	Include []string
+	Exclude []string
+}
+
+// Filters the set of regex filters to apply when selecting which MAAS nodes
+// to operate on
+type Filters struct {
+	Hosts ZoneHostFilter
+	Zones ZoneHostFilter
+}
+
+// Discoverer locates the MAAS API endpoint and the host/zone filters to run
+// against it. Implementations may be backed by static configuration or by an
+// external catalog such as Consul; swapping the Discoverer a caller uses is
+// the only thing that changes between the two.
+type Discoverer interface {
+	// Endpoint returns the MAAS API base URL to use
+	Endpoint() (string, error)
+
+	// Filters returns the current host/zone include/exclude filters
+	Filters() (Filters, error)
+}
+
+// StaticDiscoverer a Discoverer backed by fixed, already-known configuration.
+// It exists so callers that don't run Consul keep working unchanged.
+type StaticDiscoverer struct {
+	MaasEndpoint string
+	Filter       Filters
+}
+
+// NewStaticDiscoverer wraps an already-resolved endpoint and filter set as a
+// Discoverer
+func NewStaticDiscoverer(endpoint string, filter Filters) *StaticDiscoverer {
+	return &StaticDiscoverer{MaasEndpoint: endpoint, Filter: filter}
+}
+
+// Endpoint returns the configured MAAS API base URL
+func (s *StaticDiscoverer) Endpoint() (string, error) {
+	return s.MaasEndpoint, nil
+}
+
+// Filters returns the configured host/zone filters
+func (s *StaticDiscoverer) Filters() (Filters, error) {
+	return s.Filter, nil
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	log "github.com/sirupsen/logrus"
+)
+
+// metricTransitionsTotal counts every attempted state transition, labeled by
+// the action taken, the state it moved from/to, and whether it succeeded
+var metricTransitionsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "maasflow_transitions_total",
+	Help: "Total number of node state transitions attempted",
+}, []string{"action", "from", "to", "result"})
+
+// metricActionDuration tracks how long each action takes to run against MAAS
+var metricActionDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+	Name: "maasflow_action_duration_seconds",
+	Help: "Time taken to run a transition action against MAAS",
+}, []string{"action"})
+
+// metricNodesInState a point-in-time count of nodes in each substatus,
+// sampled once per ProcessAll pass
+var metricNodesInState = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "maasflow_nodes_in_state",
+	Help: "Number of nodes currently observed in each substatus",
+}, []string{"state"})
+
+// metricFilterSkippedTotal counts nodes ProcessNode skipped because they
+// didn't match the configured host/zone filters
+var metricFilterSkippedTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "maasflow_filter_skipped_total",
+	Help: "Total number of nodes skipped because they didn't match a filter",
+}, []string{"reason"})
+
+func init() {
+	prometheus.MustRegister(
+		metricTransitionsTotal,
+		metricActionDuration,
+		metricNodesInState,
+		metricFilterSkippedTotal,
+	)
+}
+
+// StartMetricsServer exposes the Prometheus metrics registered above on addr
+// at /metrics. It serves from a background goroutine and returns
+// immediately; if the server fails, the process exits.
+func StartMetricsServer(addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+
+	go func() {
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			log.Fatalf("[error] metrics server failed: %s", err)
+		}
+	}()
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	maas "github.com/juju/gomaasapi"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/davidkbainbridge/maas-flow/discovery"
+	"github.com/davidkbainbridge/maas-flow/store"
+)
+
+// ReconcilerConfig the subset of ProcessingOptions that can be hot reloaded
+// from the on-disk config file without restarting the daemon
+type ReconcilerConfig struct {
+	Filter struct {
+		Zones struct {
+			Include []string
+			Exclude []string
+		}
+		Hosts struct {
+			Include []string
+			Exclude []string
+		}
+	}
+	Concurrency int
+	Target      string
+	Preview     bool
+}
+
+// FetchNodesFunc retrieves the current MAAS inventory. watchNodes calls it
+// once every PollInterval and diffs the substatus of whatever it returns
+// against the previous pass to find changed nodes, so a change is picked up
+// on the next poll at the earliest, however the implementation obtains it.
+type FetchNodesFunc func(ctx context.Context, client *maas.MAASObject) ([]MaasNode, error)
+
+const (
+	defaultPollInterval = time.Minute
+	defaultDebounce     = 5 * time.Second
+)
+
+// Reconciler drives MAAS nodes toward ReconcilerConfig.Target: it polls
+// FetchNodes every PollInterval and dispatches only the nodes whose substatus
+// changed since the previous poll, coalesces repeated changes for one node
+// within the Debounce window into a single dispatch, and hot reloads its
+// config from ConfigPath via fsnotify. It does not subscribe to MAAS's
+// event/notification API; polling is its only source of node changes.
+type Reconciler struct {
+	Client       *maas.MAASObject
+	Store        store.TransitionStore
+	Discoverer   discovery.Discoverer
+	FetchNodes   FetchNodesFunc
+	ConfigPath   string
+	PollInterval time.Duration
+	Debounce     time.Duration
+
+	mu     sync.RWMutex
+	config ReconcilerConfig
+
+	pendingMu sync.Mutex
+	pending   map[string]*time.Timer
+}
+
+// NewReconciler loads ConfigPath and returns a Reconciler ready to Run
+func NewReconciler(client *maas.MAASObject, configPath string, fetchNodes FetchNodesFunc) (*Reconciler, error) {
+	config, err := loadReconcilerConfig(configPath)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Reconciler{
+		Client:     client,
+		FetchNodes: fetchNodes,
+		ConfigPath: configPath,
+		config:     config,
+		pending:    map[string]*time.Timer{},
+	}, nil
+}
+
+func loadReconcilerConfig(path string) (ReconcilerConfig, error) {
+	var config ReconcilerConfig
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return config, fmt.Errorf("reading config '%s': %s", path, err)
+	}
+	if err := json.Unmarshal(data, &config); err != nil {
+		return config, fmt.Errorf("parsing config '%s': %s", path, err)
+	}
+	return config, nil
+}
+
+// Run watches ConfigPath and MAAS for changes until ctx is canceled
+func (r *Reconciler) Run(ctx context.Context) error {
+	done := make(chan error, 2)
+	go func() { done <- r.watchConfig(ctx) }()
+	go func() { done <- r.watchNodes(ctx) }()
+
+	for i := 0; i < 2; i++ {
+		if err := <-done; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// options snapshots the current config as a ProcessingOptions ready to hand
+// to ProcessNode
+func (r *Reconciler) options() ProcessingOptions {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	options := ProcessingOptions{
+		Preview:     r.config.Preview,
+		Concurrency: r.config.Concurrency,
+		Discoverer:  r.Discoverer,
+		Store:       r.Store,
+		Target:      r.config.Target,
+	}
+	options.Filter.Hosts = r.config.Filter.Hosts
+	options.Filter.Zones = r.config.Filter.Zones
+
+	return options
+}
+
+func (r *Reconciler) pollInterval() time.Duration {
+	if r.PollInterval <= 0 {
+		return defaultPollInterval
+	}
+	return r.PollInterval
+}
+
+func (r *Reconciler) debounce() time.Duration {
+	if r.Debounce <= 0 {
+		return defaultDebounce
+	}
+	return r.Debounce
+}
+
+// watchConfig reloads ConfigPath whenever fsnotify reports it changed,
+// atomically swapping the config a reload sees against
+func (r *Reconciler) watchConfig(ctx context.Context) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("creating config watcher: %s", err)
+	}
+	defer watcher.Close()
+
+	// Watch the containing directory rather than the file itself so we
+	// still notice changes made by editors that replace the file (write to
+	// a temp file, then rename over the original) rather than writing to it
+	// in place.
+	if err := watcher.Add(filepath.Dir(r.ConfigPath)); err != nil {
+		return fmt.Errorf("watching config directory: %s", err)
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return nil
+			}
+			if filepath.Clean(event.Name) != filepath.Clean(r.ConfigPath) {
+				continue
+			}
+			if event.Op&(fsnotify.Write|fsnotify.Create) == 0 {
+				continue
+			}
+			r.reloadConfig()
+
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return nil
+			}
+			log.Warnf("config watcher error: %s", err)
+		}
+	}
+}
+
+// reloadConfig re-reads ConfigPath and swaps it in, logging which fields
+// changed
+func (r *Reconciler) reloadConfig() {
+	next, err := loadReconcilerConfig(r.ConfigPath)
+	if err != nil {
+		log.Warnf("unable to reload config '%s', keeping previous values: %s", r.ConfigPath, err)
+		return
+	}
+
+	r.mu.Lock()
+	previous := r.config
+	r.config = next
+	r.mu.Unlock()
+
+	changed := changedFields(previous, next)
+	if len(changed) == 0 {
+		return
+	}
+	for _, field := range changed {
+		log.Infof("config field '%s' changed on reload", field)
+	}
+}
+
+// changedFields compares two ReconcilerConfig values field by field,
+// recursing into the nested Filter struct, and returns the dotted names of
+// the ones that differ
+func changedFields(a, b ReconcilerConfig) []string {
+	var changed []string
+
+	var walk func(prefix string, a, b reflect.Value)
+	walk = func(prefix string, a, b reflect.Value) {
+		t := a.Type()
+		for i := 0; i < t.NumField(); i++ {
+			name := prefix + t.Field(i).Name
+			fa, fb := a.Field(i), b.Field(i)
+			if fa.Kind() == reflect.Struct {
+				walk(name+".", fa, fb)
+				continue
+			}
+			if !reflect.DeepEqual(fa.Interface(), fb.Interface()) {
+				changed = append(changed, name)
+			}
+		}
+	}
+	walk("", reflect.ValueOf(a), reflect.ValueOf(b))
+
+	return changed
+}
+
+// watchNodes polls MAAS every pollInterval for nodes whose substatus has
+// changed since the last pass, and schedules a debounced ProcessNode
+// dispatch for each one. This is the fallback for FetchNodes implementations
+// that can't do better; one backed by MAAS's event/notification API could
+// call scheduleDispatch directly as events arrive instead of waiting on the
+// ticker.
+func (r *Reconciler) watchNodes(ctx context.Context) error {
+	ticker := time.NewTicker(r.pollInterval())
+	defer ticker.Stop()
+
+	lastSeen := map[string]string{}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+
+		case <-ticker.C:
+			nodes, err := r.FetchNodes(ctx, r.Client)
+			if err != nil {
+				log.Warnf("unable to poll MAAS for node changes: %s", err)
+				continue
+			}
+
+			for _, node := range nodes {
+				substatus, err := node.GetInteger("substatus")
+				if err != nil {
+					continue
+				}
+
+				state := MaasNodeStatus(substatus).String()
+				if lastSeen[node.ID()] == state {
+					continue
+				}
+				lastSeen[node.ID()] = state
+
+				r.scheduleDispatch(ctx, node)
+			}
+		}
+	}
+}
+
+// scheduleDispatch coalesces repeated change notifications for the same node
+// within the debounce window into a single ProcessNode call
+func (r *Reconciler) scheduleDispatch(ctx context.Context, node MaasNode) {
+	nodeID := node.ID()
+
+	r.pendingMu.Lock()
+	defer r.pendingMu.Unlock()
+
+	if timer, ok := r.pending[nodeID]; ok {
+		timer.Stop()
+	}
+
+	r.pending[nodeID] = time.AfterFunc(r.debounce(), func() {
+		r.pendingMu.Lock()
+		delete(r.pending, nodeID)
+		r.pendingMu.Unlock()
+
+		if err := ProcessNode(ctx, r.Client, node, r.options()); err != nil {
+			log.Warnf("unable to process node '%s': %s", node.Hostname(), err)
+		}
+	})
+}
@@ -1,16 +1,53 @@
 package main
 
 import (
+	"context"
 	"fmt"
-	"log"
 	"net/url"
 	"regexp"
+	"sync"
+	"time"
 
 	maas "github.com/juju/gomaasapi"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/davidkbainbridge/maas-flow/discovery"
+	"github.com/davidkbainbridge/maas-flow/store"
+)
+
+// Action how to get from there to here. ctx carries the current/target
+// states being transitioned between (see withTransition) and is canceled if
+// the run is being shut down, so actions should check it before making any
+// MAAS API call.
+type Action func(ctx context.Context, client *maas.MAASObject, node MaasNode, options ProcessingOptions) error
+
+// transitionContextKey distinguishes this package's context values from
+// everyone else's
+type transitionContextKey int
+
+const (
+	currentStateKey transitionContextKey = iota
+	targetStateKey
 )
 
-// Action how to get from there to here
-type Action func(*maas.MAASObject, MaasNode, ProcessingOptions) error
+// withTransition attaches the current/target states being transitioned
+// between to ctx, so an Action (and the logging/metrics wrapped around it)
+// can recover them without widening Action's signature further
+func withTransition(ctx context.Context, current string, target string) context.Context {
+	ctx = context.WithValue(ctx, currentStateKey, current)
+	ctx = context.WithValue(ctx, targetStateKey, target)
+	return ctx
+}
+
+func transitionCurrent(ctx context.Context) string {
+	state, _ := ctx.Value(currentStateKey).(string)
+	return state
+}
+
+func transitionTarget(ctx context.Context) string {
+	state, _ := ctx.Value(targetStateKey).(string)
+	return state
+}
 
 // Transition the map from where i want to be from where i might be
 type Transition struct {
@@ -33,43 +70,145 @@ type ProcessingOptions struct {
 	}
 	Verbose bool
 	Preview bool
+
+	// Concurrency how many nodes ProcessAll will act on at once. Values less
+	// than 1 are treated as 1.
+	Concurrency int
+
+	// Discoverer, when set, is consulted by ProcessAll at the start of every
+	// pass to refresh Filter from whatever service discovery backend is
+	// configured (e.g. Consul), rather than relying solely on the filters
+	// Filter was populated with at startup
+	Discoverer discovery.Discoverer
+
+	// Store, when set, is consulted by ProcessNode before dispatching an
+	// action so retries can be backed off and crash-recovered
+	Store store.TransitionStore
+
+	// Target the state ProcessNode will try to move nodes toward. Empty
+	// defaults to "Deployed".
+	Target string
 }
 
-// Transitions the actual map
-//
-// Currently this is a hand compiled / optimized "next step" table. This should
-// really be generated from the state machine chart input. Once this has been
-// accomplished you should be able to determine the action to take given your
-// target state and your current state.
-var Transitions = map[string]map[string]Action{
-	"Deployed": {
-		"New":                 Commission,
-		"Deployed":            Done,
-		"Ready":               Aquire,
-		"Allocated":           Deploy,
-		"Retired":             AdminState,
-		"Reserved":            AdminState,
-		"Releasing":           Wait,
-		"DiskErasing":         Wait,
-		"Deploying":           Wait,
-		"Commissioning":       Wait,
-		"Missing":             Fail,
-		"FailedReleasing":     Fail,
-		"FailedDiskErasing":   Fail,
-		"FailedDeployment":    Fail,
-		"Broken":              Fail,
-		"FailedCommissioning": Fail,
-	},
+// backoff tuning for nodes whose most recent action was a Fail or returned
+// an error
+const (
+	baseRetryBackoff = 30 * time.Second
+	maxRetryBackoff  = 30 * time.Minute
+)
+
+// nextRetryBackoff returns how long to wait before retrying a node that has
+// just failed for the attempts-th time in a row, doubling each time up to
+// maxRetryBackoff
+func nextRetryBackoff(attempts int) time.Duration {
+	backoff := baseRetryBackoff << uint(attempts)
+	if backoff <= 0 || backoff > maxRetryBackoff {
+		return maxRetryBackoff
+	}
+	return backoff
+}
+
+// recordTransitionOutcome updates a node's persisted transition state after
+// an action returns, resetting the retry count on success and applying
+// exponential backoff on a Fail outcome or error
+func recordTransitionOutcome(s store.TransitionStore, nodeID string, current string, actionName string, actionErr error) {
+	state, err := s.Get(nodeID)
+	if err != nil {
+		log.Warnf("unable to load transition state for node '%s', recording outcome anyway: %s", nodeID, err)
+	}
+
+	state.LastObservedSubstatus = current
+	state.LastAction = actionName
+
+	if actionErr != nil || actionName == "fail" {
+		state.Attempts++
+		state.NextRetryAt = time.Now().Add(nextRetryBackoff(state.Attempts))
+		if actionErr != nil {
+			state.LastError = actionErr.Error()
+		}
+	} else {
+		state.Attempts = 0
+		state.NextRetryAt = time.Time{}
+		state.LastError = ""
+	}
+
+	if err := s.Put(nodeID, state); err != nil {
+		log.Warnf("unable to persist transition state for node '%s': %s", nodeID, err)
+	}
+}
+
+// applyDiscoveredFilters overwrites options.Filter with the values currently
+// reported by options.Discoverer, if one is configured
+func applyDiscoveredFilters(options *ProcessingOptions) {
+	if options.Discoverer == nil {
+		return
+	}
+
+	filters, err := options.Discoverer.Filters()
+	if err != nil {
+		log.Printf("[warn] unable to refresh filters from discovery, keeping previous values: %s", err)
+		return
+	}
+
+	options.Filter.Hosts.Include = filters.Hosts.Include
+	options.Filter.Hosts.Exclude = filters.Hosts.Exclude
+	options.Filter.Zones.Include = filters.Zones.Include
+	options.Filter.Zones.Exclude = filters.Zones.Exclude
+}
+
+// edgeRE matches a single "(From)->(To)" hop in the state machine DSL
+var edgeRE = regexp.MustCompile(`\(\s*(\w+)\s*\)\s*->\s*\(\s*(\w+)\s*\)`)
+
+// namedAction an Action together with the name it should be identified by in
+// logs, metrics, and the transition store
+type namedAction struct {
+	Name   string
+	Action Action
+}
+
+// actionByStep maps the state a hop arrives at to the semantic action that
+// performs that hop. This is the declarative edge-type -> action mapping: to
+// teach the planner about a new intermediate state, add the state machine
+// edges to the DSL below and, if the state isn't a simple wait step, give it
+// an entry here. Failure states don't belong here: they're handled by
+// failureStates below, not walked into by the planner.
+var actionByStep = map[string]namedAction{
+	"Commissioning": {"commission", Commission},
+	"Allocated":     {"aquire", Aquire},
+	"Deploying":     {"deploy", Deploy},
+	"Ready":         {"wait", Wait},
+	"Releasing":     {"wait", Wait},
+	"DiskErasing":   {"wait", Wait},
+}
+
+// adminStates states we should never attempt to automatically transition out
+// of, regardless of what the planner finds
+var adminStates = map[string]bool{
+	"Retired":  true,
+	"Reserved": true,
+}
+
+// failureStates states that require manual intervention to leave. MAAS puts
+// a node into one of these on its own; the planner can't act its way out of
+// one, so these are never walked into as an ordinary waypoint, and landing
+// in one is reported directly as Fail rather than planned past.
+var failureStates = map[string]bool{
+	"Broken":              true,
+	"FailedCommissioning": true,
+	"FailedDeployment":    true,
+	"FailedReleasing":     true,
+	"FailedDiskErasing":   true,
 }
 
 const (
-	// defaultStateMachine Would be nice to drive from a graph language
+	// defaultStateMachine the graph of valid MAAS node state transitions,
+	// expressed as "(From)->(To)" hops, one per line. findAction plans a
+	// path through this graph rather than consulting a hand built table.
 	defaultStateMachine string = `
         (New)->(Commissioning)
         (Commissioning)->(FailedCommissioning)
         (FailedCommissioning)->(New)
         (Commissioning)->(Ready)
-        (Ready)->(Deploying)
         (Ready)->(Allocated)
         (Allocated)->(Deploying)
         (Deploying)->(Deployed)
@@ -79,22 +218,221 @@ const (
         (Releasing)->(FailedReleasing)
         (FailedReleasing)->(Broken)
         (Releasing)->(DiskErasing)
-        (DiskErasing)->(FailedEraseDisk)
-        (FailedEraseDisk)->(Broken)
+        (DiskErasing)->(FailedDiskErasing)
+        (FailedDiskErasing)->(Broken)
         (Releasing)->(Ready)
         (DiskErasing)->(Ready)
         (Broken)->(Ready)`
 )
 
+// stateGraph adjacency list built from a parsed state machine DSL, along with
+// the per (target, current) next-hop cache computed against it
+type stateGraph struct {
+	edges map[string][]string
+
+	mu    sync.RWMutex
+	cache map[string]map[string]namedAction
+}
+
+// parseStateMachine parses a "(From)->(To)" DSL into a directed graph. Edges
+// are kept in declaration order so planning stays deterministic.
+func parseStateMachine(dsl string) (map[string][]string, error) {
+	matches := edgeRE.FindAllStringSubmatch(dsl, -1)
+	if len(matches) == 0 {
+		return nil, fmt.Errorf("state machine DSL contained no '(From)->(To)' edges")
+	}
+
+	graph := map[string][]string{}
+	for _, m := range matches {
+		from, to := m[1], m[2]
+		graph[from] = append(graph[from], to)
+	}
+	return graph, nil
+}
+
+// newStateGraph parses dsl and returns a ready-to-use graph with an empty
+// next-hop cache
+func newStateGraph(dsl string) (*stateGraph, error) {
+	edges, err := parseStateMachine(dsl)
+	if err != nil {
+		return nil, err
+	}
+	return &stateGraph{
+		edges: edges,
+		cache: map[string]map[string]namedAction{},
+	}, nil
+}
+
+// reload re-parses dsl and invalidates the next-hop cache, so the next
+// findAction call for any (target, current) pair is recomputed from the new
+// graph
+func (g *stateGraph) reload(dsl string) error {
+	edges, err := parseStateMachine(dsl)
+	if err != nil {
+		return err
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.edges = edges
+	g.cache = map[string]map[string]namedAction{}
+	return nil
+}
+
+// nextHop returns the first state to visit on the shortest path from current
+// to target, found via a breadth first search of the graph. failureStates
+// are never walked into as a waypoint, since they can only be reached by
+// MAAS itself and require manual intervention to leave.
+func (g *stateGraph) nextHop(target string, current string) (string, bool) {
+	type step struct {
+		state string
+		first string
+	}
+
+	visited := map[string]bool{current: true}
+	queue := []step{{state: current}}
+
+	for len(queue) > 0 {
+		s := queue[0]
+		queue = queue[1:]
+
+		if s.state == target {
+			return s.first, true
+		}
+
+		for _, next := range g.edges[s.state] {
+			if visited[next] || failureStates[next] {
+				continue
+			}
+			visited[next] = true
+
+			first := s.first
+			if first == "" {
+				first = next
+			}
+			queue = append(queue, step{state: next, first: first})
+		}
+	}
+	return "", false
+}
+
+// findAction returns the cached, metrics-instrumented action for (target,
+// current) along with its name, computing and caching it via the graph if
+// this is the first time the pair is seen
+func (g *stateGraph) findAction(target string, current string) (Action, string, error) {
+	g.mu.RLock()
+	if byCurrent, ok := g.cache[target]; ok {
+		if na, ok := byCurrent[current]; ok {
+			g.mu.RUnlock()
+			return na.Action, na.Name, nil
+		}
+	}
+	g.mu.RUnlock()
+
+	na, err := g.planAction(target, current)
+	if err != nil {
+		return nil, "", err
+	}
+	na.Action = withMetrics(na.Name, na.Action)
+
+	g.mu.Lock()
+	if g.cache[target] == nil {
+		g.cache[target] = map[string]namedAction{}
+	}
+	g.cache[target][current] = na
+	g.mu.Unlock()
+
+	return na.Action, na.Name, nil
+}
+
+// planAction computes, uncached, the action to take given a target and
+// current state
+func (g *stateGraph) planAction(target string, current string) (namedAction, error) {
+	if current == target {
+		return namedAction{"done", Done}, nil
+	}
+
+	if adminStates[current] {
+		return namedAction{"admin-state", AdminState}, nil
+	}
+
+	if failureStates[current] {
+		return namedAction{"fail", Fail}, nil
+	}
+
+	next, ok := g.nextHop(target, current)
+	if !ok {
+		log.Warnf("unable to find transition from current state '%s' to target state '%s'",
+			current, target)
+		return namedAction{"fail", Fail}, nil
+	}
+
+	if na, ok := actionByStep[next]; ok {
+		return na, nil
+	}
+
+	// No action is registered for next, so getting there is MAAS-driven
+	// rather than something we dispatch (e.g. Deploying -> Deployed):
+	// there's nothing to do but wait for it to land.
+	return namedAction{"wait", Wait}, nil
+}
+
+// defaultGraph the graph compiled from defaultStateMachine, used by
+// findAction unless reloaded
+var defaultGraph = mustNewStateGraph(defaultStateMachine)
+
+func mustNewStateGraph(dsl string) *stateGraph {
+	g, err := newStateGraph(dsl)
+	if err != nil {
+		log.Fatalf("[error] invalid state machine DSL: %s", err)
+	}
+	return g
+}
+
+// transitionFields builds the common set of logrus fields attached to every
+// transition log entry
+func transitionFields(ctx context.Context, node MaasNode, options ProcessingOptions, action string) log.Fields {
+	return log.Fields{
+		"hostname":      node.Hostname(),
+		"node_id":       node.ID(),
+		"zone":          node.Zone(),
+		"current_state": transitionCurrent(ctx),
+		"target_state":  transitionTarget(ctx),
+		"action":        action,
+		"preview":       options.Preview,
+	}
+}
+
+// withMetrics wraps an Action so that every invocation records its outcome in
+// metricTransitionsTotal and its duration in metricActionDuration, labeled by
+// name
+func withMetrics(name string, fn Action) Action {
+	return func(ctx context.Context, client *maas.MAASObject, node MaasNode, options ProcessingOptions) error {
+		start := time.Now()
+		err := fn(ctx, client, node, options)
+		metricActionDuration.WithLabelValues(name).Observe(time.Since(start).Seconds())
+
+		result := "success"
+		if err != nil {
+			result = "error"
+		}
+		metricTransitionsTotal.WithLabelValues(name, transitionCurrent(ctx), transitionTarget(ctx), result).Inc()
+		return err
+	}
+}
+
 // Done we are at the target state, nothing to do
-var Done = func(client *maas.MAASObject, node MaasNode, options ProcessingOptions) error {
-	log.Printf("COMPLETE: %s", node.Hostname())
+var Done = func(ctx context.Context, client *maas.MAASObject, node MaasNode, options ProcessingOptions) error {
+	log.WithFields(transitionFields(ctx, node, options, "done")).Info("node has reached its target state")
 	return nil
 }
 
 // Deploy cause a node to deploy
-var Deploy = func(client *maas.MAASObject, node MaasNode, options ProcessingOptions) error {
-	log.Printf("DEPLOY: %s", node.Hostname())
+var Deploy = func(ctx context.Context, client *maas.MAASObject, node MaasNode, options ProcessingOptions) error {
+	log.WithFields(transitionFields(ctx, node, options, "deploy")).Info("deploying node")
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
 	if !options.Preview {
 		nodesObj := client.GetSubObject("nodes")
 		myNode := nodesObj.GetSubObject(node.ID())
@@ -107,8 +445,11 @@ var Deploy = func(client *maas.MAASObject, node MaasNode, options ProcessingOpti
 }
 
 // Aquire aquire a machine to a specific operator
-var Aquire = func(client *maas.MAASObject, node MaasNode, options ProcessingOptions) error {
-	log.Printf("AQUIRE: %s", node.Hostname())
+var Aquire = func(ctx context.Context, client *maas.MAASObject, node MaasNode, options ProcessingOptions) error {
+	log.WithFields(transitionFields(ctx, node, options, "aquire")).Info("aquiring node")
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
 	if !options.Preview {
 		nodesObj := client.GetSubObject("nodes")
 		params := url.Values{"name": []string{node.Hostname()}}
@@ -121,8 +462,11 @@ var Aquire = func(client *maas.MAASObject, node MaasNode, options ProcessingOpti
 }
 
 // Commission cause a node to be commissioned
-var Commission = func(client *maas.MAASObject, node MaasNode, options ProcessingOptions) error {
-	log.Printf("COMISSION: %s", node.Hostname())
+var Commission = func(ctx context.Context, client *maas.MAASObject, node MaasNode, options ProcessingOptions) error {
+	log.WithFields(transitionFields(ctx, node, options, "commission")).Info("commissioning node")
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
 	if !options.Preview {
 
 		nodesObj := client.GetSubObject("nodes")
@@ -136,58 +480,73 @@ var Commission = func(client *maas.MAASObject, node MaasNode, options Processing
 }
 
 // Wait a do nothing state, while work is being done
-var Wait = func(client *maas.MAASObject, node MaasNode, options ProcessingOptions) error {
-	log.Printf("WAIT: %s", node.Hostname())
+var Wait = func(ctx context.Context, client *maas.MAASObject, node MaasNode, options ProcessingOptions) error {
+	log.WithFields(transitionFields(ctx, node, options, "wait")).Info("waiting for in-progress work to complete")
 	return nil
 }
 
 // Fail a state from which we cannot, currently, automatically recover
-var Fail = func(client *maas.MAASObject, node MaasNode, options ProcessingOptions) error {
-	log.Printf("FAIL: %s", node.Hostname())
+var Fail = func(ctx context.Context, client *maas.MAASObject, node MaasNode, options ProcessingOptions) error {
+	log.WithFields(transitionFields(ctx, node, options, "fail")).Warn("node is in a state that requires manual intervention")
 	return nil
 }
 
 // AdminState an administrative state from which we should make no automatic transition
-var AdminState = func(client *maas.MAASObject, node MaasNode, options ProcessingOptions) error {
-	log.Printf("ADMIN: %s", node.Hostname())
+var AdminState = func(ctx context.Context, client *maas.MAASObject, node MaasNode, options ProcessingOptions) error {
+	log.WithFields(transitionFields(ctx, node, options, "admin-state")).Info("node is in an administrative state, leaving it alone")
 	return nil
 }
 
-func findAction(target string, current string) (Action, error) {
-	targets, ok := Transitions[target]
-	if !ok {
-		log.Printf("[warn] unable to find transitions to target state '%s'", target)
-		return nil, fmt.Errorf("Could not find transition to target state '%s'", target)
-	}
+func findAction(target string, current string) (Action, string, error) {
+	return defaultGraph.findAction(target, current)
+}
 
-	action, ok := targets[current]
-	if !ok {
-		log.Printf("[warn] unable to find transition from current state '%s' to target state '%s'",
-			current, target)
-		return nil, fmt.Errorf("Could not find transition from current state '%s' to target state '%s'",
-			current, target)
-	}
+// ProcessNode something. Filtering is applied here, not just in ProcessAll,
+// so that any caller driving ProcessNode directly (such as the Reconciler)
+// still honors options.Filter and options.Discoverer.
+func ProcessNode(ctx context.Context, client *maas.MAASObject, node MaasNode, options ProcessingOptions) error {
+	applyDiscoveredFilters(&options)
 
-	return action, nil
-}
+	filter, err := buildNodeFilter(options)
+	if err != nil {
+		return err
+	}
+	if !filter.matches(options, node) {
+		return nil
+	}
 
-// ProcessNode something
-func ProcessNode(client *maas.MAASObject, node MaasNode, options ProcessingOptions) error {
 	substatus, err := node.GetInteger("substatus")
 	if err != nil {
 		return err
 	}
-	action, err := findAction("Deployed", MaasNodeStatus(substatus).String())
+	current := MaasNodeStatus(substatus).String()
+	target := options.Target
+	if target == "" {
+		target = "Deployed"
+	}
+	nodeID := node.ID()
+
+	if options.Store != nil {
+		state, err := options.Store.Get(nodeID)
+		if err != nil {
+			log.Warnf("unable to load transition state for node '%s', proceeding without backoff: %s", nodeID, err)
+		} else if !state.NextRetryAt.IsZero() && time.Now().Before(state.NextRetryAt) {
+			log.WithFields(log.Fields{"hostname": node.Hostname(), "node_id": nodeID, "attempts": state.Attempts}).
+				Infof("skipping node, in backoff until %s", state.NextRetryAt.Format(time.RFC3339))
+			return nil
+		}
+	}
+
+	action, actionName, err := findAction(target, current)
 	if err != nil {
 		return err
 	}
 
-	if options.Preview {
-		action(client, node, options)
-	} else {
-		go action(client, node, options)
+	actionErr := action(withTransition(ctx, current, target), client, node, options)
+	if options.Store != nil {
+		recordTransitionOutcome(options.Store, nodeID, current, actionName, actionErr)
 	}
-	return nil
+	return actionErr
 }
 
 func buildFilter(filter []string) ([]*regexp.Regexp, error) {
@@ -203,52 +562,141 @@ func buildFilter(filter []string) ([]*regexp.Regexp, error) {
 	return results, nil
 }
 
-func matchedFilter(include []*regexp.Regexp, target string) bool {
-	for _, e := range include {
+// matchedFilter reports whether target matches include and doesn't match
+// exclude. matchAllOnEmpty controls what happens when include has no
+// patterns at all: hosts default to matching everything, zones default to
+// matching nothing, per their respective call sites below. exclude always
+// wins: a target matching both include and exclude is not matched.
+func matchedFilter(include []*regexp.Regexp, exclude []*regexp.Regexp, target string, matchAllOnEmpty bool) bool {
+	included := matchAllOnEmpty
+	if len(include) > 0 {
+		included = false
+		for _, e := range include {
+			if e.MatchString(target) {
+				included = true
+				break
+			}
+		}
+	}
+	if !included {
+		return false
+	}
+
+	for _, e := range exclude {
 		if e.MatchString(target) {
-			return true
+			return false
 		}
 	}
-	return false
+	return true
 }
 
-// ProcessAll something
-func ProcessAll(client *maas.MAASObject, nodes []MaasNode, options ProcessingOptions) []error {
-	errors := make([]error, len(nodes))
-	includeHosts, err := buildFilter(options.Filter.Hosts.Include)
-	if err != nil {
-		log.Fatalf("[error] invalid regular expression for include filter '%s' : %s", options.Filter.Hosts.Include, err)
+// nodeFilter the compiled host/zone include/exclude patterns from a
+// ProcessingOptions.Filter, built once and reused across every node checked
+// against it
+type nodeFilter struct {
+	includeHosts, excludeHosts []*regexp.Regexp
+	includeZones, excludeZones []*regexp.Regexp
+}
+
+// buildNodeFilter compiles options.Filter's patterns
+func buildNodeFilter(options ProcessingOptions) (nodeFilter, error) {
+	var nf nodeFilter
+	var err error
+
+	if nf.includeHosts, err = buildFilter(options.Filter.Hosts.Include); err != nil {
+		return nf, fmt.Errorf("invalid regular expression for include hostname filter '%v': %s", options.Filter.Hosts.Include, err)
 	}
+	if nf.excludeHosts, err = buildFilter(options.Filter.Hosts.Exclude); err != nil {
+		return nf, fmt.Errorf("invalid regular expression for exclude hostname filter '%v': %s", options.Filter.Hosts.Exclude, err)
+	}
+	if nf.includeZones, err = buildFilter(options.Filter.Zones.Include); err != nil {
+		return nf, fmt.Errorf("invalid regular expression for include zone filter '%v': %s", options.Filter.Zones.Include, err)
+	}
+	if nf.excludeZones, err = buildFilter(options.Filter.Zones.Exclude); err != nil {
+		return nf, fmt.Errorf("invalid regular expression for exclude zone filter '%v': %s", options.Filter.Zones.Exclude, err)
+	}
+	return nf, nil
+}
 
-	includeZones, err := buildFilter(options.Filter.Zones.Include)
-	if err != nil {
-		log.Fatalf("[error] invalid regular expression for include filter '%v' : %s", options.Filter.Zones.Include, err)
+// matches reports whether node passes the host/zone filters, incrementing
+// metricFilterSkippedTotal and logging (when options.Verbose) for whichever
+// one it fails
+func (nf nodeFilter) matches(options ProcessingOptions, node MaasNode) bool {
+	// Hosts always match on an empty include filter
+	if !matchedFilter(nf.includeHosts, nf.excludeHosts, node.Hostname(), true) {
+		metricFilterSkippedTotal.WithLabelValues("host").Inc()
+		if options.Verbose {
+			log.Printf("[info] ignoring node '%s' as it didn't match the hostname filter", node.Hostname())
+		}
+		return false
 	}
 
-	for i, node := range nodes {
-		// For hostnames we always match on an empty filter
-		if len(includeHosts) >= 0 && matchedFilter(includeHosts, node.Hostname()) {
-
-			// For zones we don't match on an empty filter
-			if len(includeZones) >= 0 && matchedFilter(includeZones, node.Zone()) {
-				err := ProcessNode(client, node, options)
-				if err != nil {
-					errors[i] = err
-				} else {
-					errors[i] = nil
-				}
-			} else {
-				if options.Verbose {
-					log.Printf("[info] ignoring node '%s' as its zone '%s' didn't match include zone name filter '%v'",
-						node.Hostname(), node.Zone(), options.Filter.Zones.Include)
+	// Zones don't match on an empty include filter
+	if !matchedFilter(nf.includeZones, nf.excludeZones, node.Zone(), false) {
+		metricFilterSkippedTotal.WithLabelValues("zone").Inc()
+		if options.Verbose {
+			log.Printf("[info] ignoring node '%s' as its zone '%s' didn't match the zone filter", node.Hostname(), node.Zone())
+		}
+		return false
+	}
+
+	return true
+}
+
+// nodeJob one unit of work fed to ProcessAll's worker pool
+type nodeJob struct {
+	index int
+	node  MaasNode
+}
+
+// ProcessAll something. Host/zone filtering happens inside ProcessNode, not
+// here, so that filtering stays identical whether a node is reached via a
+// full ProcessAll pass or dispatched directly (as the Reconciler does).
+func ProcessAll(ctx context.Context, client *maas.MAASObject, nodes []MaasNode, options ProcessingOptions) []error {
+	applyDiscoveredFilters(&options)
+
+	errors := make([]error, len(nodes))
+
+	metricNodesInState.Reset()
+
+	concurrency := options.Concurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	jobs := make(chan nodeJob)
+	var workers sync.WaitGroup
+	for w := 0; w < concurrency; w++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for j := range jobs {
+				if ctx.Err() != nil {
+					errors[j.index] = ctx.Err()
+					continue
 				}
+				errors[j.index] = ProcessNode(ctx, client, j.node, options)
 			}
-		} else {
-			if options.Verbose {
-				log.Printf("[info] ignoring node '%s' as it didn't match include hostname filter '%v'",
-					node.Hostname(), options.Filter.Hosts.Include)
+		}()
+	}
+
+feeding:
+	for i, node := range nodes {
+		if substatus, err := node.GetInteger("substatus"); err == nil {
+			metricNodesInState.WithLabelValues(MaasNodeStatus(substatus).String()).Inc()
+		}
+
+		select {
+		case jobs <- nodeJob{index: i, node: node}:
+		case <-ctx.Done():
+			for remaining := i; remaining < len(nodes); remaining++ {
+				errors[remaining] = ctx.Err()
 			}
+			break feeding
 		}
 	}
+	close(jobs)
+	workers.Wait()
+
 	return errors
 }
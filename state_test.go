@@ -0,0 +1,54 @@
+package main
+
+import "testing"
+
+// baselineAction is the action name the original hand-built Transitions
+// table mapped each MAAS substatus to when the target state is "Deployed".
+// findAction should agree with it for every status, even though it gets
+// there by planning a path through defaultStateMachine instead of a flat
+// lookup.
+var baselineAction = map[string]string{
+	"New":                 "commission",
+	"Commissioning":       "wait",
+	"Ready":               "aquire",
+	"Allocated":           "deploy",
+	"Deploying":           "wait",
+	"Deployed":            "done",
+	"Retired":             "admin-state",
+	"Reserved":            "admin-state",
+	"Releasing":           "wait",
+	"DiskErasing":         "wait",
+	"Missing":             "fail",
+	"FailedReleasing":     "fail",
+	"FailedDiskErasing":   "fail",
+	"FailedDeployment":    "fail",
+	"Broken":              "fail",
+	"FailedCommissioning": "fail",
+}
+
+func TestFindActionMatchesBaseline(t *testing.T) {
+	for current, want := range baselineAction {
+		t.Run(current, func(t *testing.T) {
+			_, got, err := findAction("Deployed", current)
+			if err != nil {
+				t.Fatalf("findAction(%q, %q) returned error: %s", "Deployed", current, err)
+			}
+			if got != want {
+				t.Errorf("findAction(%q, %q) = %q, want %q", "Deployed", current, got, want)
+			}
+		})
+	}
+}
+
+// TestFindActionNonDefaultTarget exercises a target other than the default
+// "Deployed", which planAction's next-hop-is-target shortcut used to treat
+// as Wait unconditionally instead of looking up the step's real action.
+func TestFindActionNonDefaultTarget(t *testing.T) {
+	_, got, err := findAction("Allocated", "Ready")
+	if err != nil {
+		t.Fatalf("findAction(%q, %q) returned error: %s", "Allocated", "Ready", err)
+	}
+	if want := "aquire"; got != want {
+		t.Errorf("findAction(%q, %q) = %q, want %q", "Allocated", "Ready", got, want)
+	}
+}
@@ -0,0 +1,67 @@
+package store
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/boltdb/bolt"
+)
+
+// transitionsBucket the single BoltDB bucket node transition state is kept
+// in
+var transitionsBucket = []byte("transitions")
+
+// BoltStore a TransitionStore backed by a local BoltDB file, for single-node
+// deployments that don't run Consul
+type BoltStore struct {
+	db *bolt.DB
+}
+
+// NewBoltStore opens (creating if necessary) a BoltDB file at path and
+// returns a TransitionStore backed by it
+func NewBoltStore(path string) (*BoltStore, error) {
+	db, err := bolt.Open(path, 0600, nil)
+	if err != nil {
+		return nil, fmt.Errorf("opening bolt store '%s': %s", path, err)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(transitionsBucket)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("initializing bolt store '%s': %s", path, err)
+	}
+
+	return &BoltStore{db: db}, nil
+}
+
+// Get returns the stored state for nodeID
+func (s *BoltStore) Get(nodeID string) (NodeState, error) {
+	var state NodeState
+	err := s.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(transitionsBucket).Get([]byte(nodeID))
+		if data == nil {
+			return nil
+		}
+		return json.Unmarshal(data, &state)
+	})
+	return state, err
+}
+
+// Put records state for nodeID
+func (s *BoltStore) Put(nodeID string, state NodeState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(transitionsBucket).Put([]byte(nodeID), data)
+	})
+}
+
+// Close releases the underlying BoltDB file
+func (s *BoltStore) Close() error {
+	return s.db.Close()
+}
@@ -0,0 +1,65 @@
+package store
+
+import (
+	"encoding/json"
+	"fmt"
+
+	consulapi "github.com/hashicorp/consul/api"
+)
+
+// defaultKeyPrefix the Consul KV prefix node transition state is kept under
+const defaultKeyPrefix = "maas-flow/transitions/"
+
+// ConsulStore a TransitionStore backed by Consul's KV store, so multiple
+// maas-flow instances can safely share one view of in-flight transitions
+type ConsulStore struct {
+	client *consulapi.Client
+	prefix string
+}
+
+// NewConsulStore returns a TransitionStore that stores node state under
+// prefix in Consul's KV store. An empty prefix defaults to
+// "maas-flow/transitions/".
+func NewConsulStore(cfg *consulapi.Config, prefix string) (*ConsulStore, error) {
+	client, err := consulapi.NewClient(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("creating consul client: %s", err)
+	}
+
+	if prefix == "" {
+		prefix = defaultKeyPrefix
+	}
+
+	return &ConsulStore{client: client, prefix: prefix}, nil
+}
+
+// Get returns the stored state for nodeID
+func (s *ConsulStore) Get(nodeID string) (NodeState, error) {
+	var state NodeState
+
+	pair, _, err := s.client.KV().Get(s.key(nodeID), nil)
+	if err != nil {
+		return state, err
+	}
+	if pair == nil {
+		return state, nil
+	}
+
+	err = json.Unmarshal(pair.Value, &state)
+	return state, err
+}
+
+// Put records state for nodeID
+func (s *ConsulStore) Put(nodeID string, state NodeState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.client.KV().Put(&consulapi.KVPair{Key: s.key(nodeID), Value: data}, nil)
+	return err
+}
+
+func (s *ConsulStore) key(nodeID string) string {
+	return s.prefix + nodeID
+}
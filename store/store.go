@@ -0,0 +1,39 @@
+// Package store persists per-node transition state so that a restart of the
+// daemon doesn't lose track of in-flight work, retry counts, or the last
+// error seen for a node.
+package store
+
+import "time"
+
+// NodeState the persisted state of a single node's in-flight transition
+type NodeState struct {
+	// LastObservedSubstatus the MAAS substatus the node was in the last time
+	// it was processed
+	LastObservedSubstatus string
+
+	// LastAction the name of the action most recently dispatched for this
+	// node (e.g. "deploy", "commission", "fail")
+	LastAction string
+
+	// Attempts how many times LastAction has been retried in a row after a
+	// Fail outcome or error
+	Attempts int
+
+	// NextRetryAt the earliest time the node should be considered again.
+	// Zero means there is no backoff in effect.
+	NextRetryAt time.Time
+
+	// LastError the error message from the most recent failed attempt, if
+	// any
+	LastError string
+}
+
+// TransitionStore persists NodeState keyed by MAAS node ID
+type TransitionStore interface {
+	// Get returns the stored state for nodeID, or the zero NodeState if
+	// nothing has been recorded for it yet
+	Get(nodeID string) (NodeState, error)
+
+	// Put records state for nodeID, replacing whatever was stored before
+	Put(nodeID string, state NodeState) error
+}